@@ -0,0 +1,303 @@
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	ferrors "github.com/open-horizon/horizon-pkg-fetch/errors"
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+)
+
+// sidecarFlushBytes is how often (in bytes written) the progress sidecar is
+// persisted to disk during a download.
+const sidecarFlushBytes = 1 << 20 // 1 MiB
+
+// progressSidecar is persisted next to a partially-downloaded part as
+// "<part>.progress" so that a resumed fetch (even across process restarts)
+// can validate that the remote object has not changed before appending to
+// the bytes already on disk.
+type progressSidecar struct {
+	Validator    string `json:"validator"`
+	BytesWritten int64  `json:"bytes_written"`
+	SHA256State  []byte `json:"sha256_so_far"`
+}
+
+func sidecarPath(partPath string) string {
+	return partPath + ".progress"
+}
+
+func loadSidecar(path string) (*progressSidecar, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var sc progressSidecar
+	if err := json.Unmarshal(raw, &sc); err != nil {
+		return nil, err
+	}
+
+	return &sc, nil
+}
+
+func saveSidecar(path string, sc *progressSidecar) error {
+	raw, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, raw, 0600)
+}
+
+func removeSidecar(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Failed to remove progress sidecar %v: %v", path, err)
+	}
+}
+
+// newResumedHash returns a SHA-256 hash.Hash, optionally resumed from
+// previously-marshaled state (via crypto/sha256's encoding.BinaryMarshaler
+// support) so a resumed download doesn't need to re-hash bytes already on
+// disk.
+func newResumedHash(marshaled []byte) (hash.Hash, error) {
+	h := sha256.New()
+	if len(marshaled) == 0 {
+		return h, nil
+	}
+
+	unmarshaler, ok := h.(interface{ UnmarshalBinary([]byte) error })
+	if !ok {
+		return nil, fmt.Errorf("sha256 hash implementation does not support resuming from binary state")
+	}
+	if err := unmarshaler.UnmarshalBinary(marshaled); err != nil {
+		return nil, fmt.Errorf("unmarshaling sha256 state: %v", err)
+	}
+
+	return h, nil
+}
+
+func marshalHash(h hash.Hash) ([]byte, error) {
+	marshaler, ok := h.(interface{ MarshalBinary() ([]byte, error) })
+	if !ok {
+		return nil, fmt.Errorf("sha256 hash implementation does not support marshaling state")
+	}
+
+	return marshaler.MarshalBinary()
+}
+
+// sidecarWriter hashes bytes as they're written and periodically persists a
+// progressSidecar so a crash mid-download loses at most sidecarFlushBytes of
+// resume progress.
+type sidecarWriter struct {
+	hash      hash.Hash
+	path      string
+	validator string
+	written   int64
+	lastFlush int64
+}
+
+func (w *sidecarWriter) Write(p []byte) (int, error) {
+	n, err := w.hash.Write(p)
+	w.written += int64(n)
+
+	if err == nil && w.written-w.lastFlush >= sidecarFlushBytes {
+		if ferr := w.flush(); ferr != nil {
+			glog.Warningf("Failed to persist progress sidecar %v: %v", w.path, ferr)
+		}
+	}
+
+	return n, err
+}
+
+func (w *sidecarWriter) flush() error {
+	state, err := marshalHash(w.hash)
+	if err != nil {
+		return err
+	}
+
+	w.lastFlush = w.written
+
+	return saveSidecar(w.path, &progressSidecar{
+		Validator:    w.validator,
+		BytesWritten: w.written,
+		SHA256State:  state,
+	})
+}
+
+// backoffWithJitter returns an exponentially-growing delay (doubling per
+// attempt) plus up to one more base's worth of jitter, so many concurrent
+// parts retrying the same flaky source don't all wake up in lockstep.
+func backoffWithJitter(base time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt-1)
+	return d + time.Duration(rand.Int63n(int64(base)+1))
+}
+
+// fetchPkgPart downloads a single Pkg part via the transport registered for
+// each source's URL scheme, resuming a previous partial download when the
+// sidecar confirms the remote object is unchanged, and verifies the final
+// byte count and SHA-256 digest (streamed as the bytes are written, never
+// buffered) before declaring success. Sources are tried in order, with up to
+// opts.MaxRetriesPerSource retries (exponential backoff with jitter) against
+// each before moving to the next. ctx cancellation aborts immediately and is
+// returned unwrapped so callers can distinguish it from network errors.
+func fetchPkgPart(ctx context.Context, client *http.Client, partID string, partPath string, expectedBytes int64, expectedDigest string, sources []horizonpkg.PartSource, opts Options, sink *progressSink) error {
+	registry := newTransportRegistry(client)
+
+	maxRetries := opts.MaxRetriesPerSource
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetriesPerSource
+	}
+	backoffBase := opts.BackoffBase
+	if backoffBase <= 0 {
+		backoffBase = defaultBackoffBase
+	}
+
+	var lastErr error
+	for _, source := range sources {
+		transport, err := registry.forSource(source)
+		if err != nil {
+			glog.Errorf("Skipping source %v for part %v: %v", source.URL, partPath, err)
+			lastErr = err
+			continue
+		}
+
+		for attempt := 0; attempt <= maxRetries; attempt++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if attempt > 0 {
+				select {
+				case <-time.After(backoffWithJitter(backoffBase, attempt)):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+			err := fetchPartFromSource(ctx, transport, partID, partPath, expectedBytes, expectedDigest, source, attempt, sink)
+			if err == nil {
+				return nil
+			}
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+
+			glog.Errorf("Attempt %v to fetch part %v from %v failed: %v", attempt+1, partPath, source.URL, err)
+			lastErr = err
+		}
+	}
+
+	return ferrors.NewSourceExhaustedError(lastErr, fmt.Sprintf("failed to complete download of %v from any of %v source(s)", partPath, len(sources)))
+}
+
+func fetchPartFromSource(ctx context.Context, transport Transport, partID string, partPath string, expectedBytes int64, expectedDigest string, source horizonpkg.PartSource, attempt int, sink *progressSink) error {
+	scPath := sidecarPath(partPath)
+
+	info, statErr := os.Stat(partPath)
+	var existingBytes int64
+	if statErr == nil {
+		existingBytes = info.Size()
+	}
+
+	if existingBytes == expectedBytes {
+		glog.V(3).Infof("Part file %v already has the expected size, skipping redownload", partPath)
+		return nil
+	}
+
+	sidecar, err := loadSidecar(scPath)
+	if err != nil {
+		glog.Warningf("Ignoring unreadable progress sidecar for %v: %v", partPath, err)
+		sidecar = nil
+	}
+
+	_, validator, err := transport.Stat(ctx, source)
+	if err != nil {
+		return ferrors.NewNetworkError(err, fmt.Sprintf("probing %v", source.URL))
+	}
+
+	resume := existingBytes > 0 && existingBytes < expectedBytes &&
+		sidecar != nil && sidecar.Validator == validator && sidecar.BytesWritten == existingBytes
+
+	var h hash.Hash
+	if resume {
+		if h, err = newResumedHash(sidecar.SHA256State); err != nil {
+			glog.Warningf("Discarding unresumable progress for %v: %v", partPath, err)
+			resume = false
+		}
+	}
+
+	var partFile *os.File
+	var offset int64
+	if resume {
+		if partFile, err = os.OpenFile(partPath, os.O_RDWR|os.O_APPEND, 0600); err != nil {
+			return ferrors.NewDiskError(err, fmt.Sprintf("opening %v to resume", partPath))
+		}
+		offset = existingBytes
+	} else {
+		if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+			return ferrors.NewDiskError(err, fmt.Sprintf("removing stale part %v", partPath))
+		}
+		removeSidecar(scPath)
+
+		if partFile, err = os.OpenFile(partPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			return ferrors.NewDiskError(err, fmt.Sprintf("creating %v", partPath))
+		}
+		h = sha256.New()
+		offset = 0
+	}
+	defer partFile.Close()
+
+	sw := &sidecarWriter{hash: h, path: scPath, validator: validator, written: offset, lastFlush: offset}
+	pw := newProgressCountingWriter(io.MultiWriter(partFile, sw), sink, partID, source.URL, attempt, expectedBytes, offset)
+
+	if _, err := transport.Fetch(ctx, source, pw, offset); err != nil {
+		if err == errRangeNotHonored {
+			// the server ignored our Range request and would send the whole
+			// object again; start this part over from scratch
+			glog.Warningf("Source %v does not honor Range requests, restarting %v from scratch", source.URL, partPath)
+			partFile.Close()
+			if rmErr := os.Remove(partPath); rmErr != nil {
+				return ferrors.NewDiskError(rmErr, fmt.Sprintf("removing stale part %v", partPath))
+			}
+			removeSidecar(scPath)
+			return fetchPartFromSource(ctx, transport, partID, partPath, expectedBytes, expectedDigest, source, attempt, sink)
+		}
+		return ferrors.NewNetworkError(err, fmt.Sprintf("downloading %v from %v", partPath, source.URL))
+	}
+
+	if info, err = os.Stat(partPath); err != nil {
+		return ferrors.NewDiskError(err, fmt.Sprintf("statting %v after download", partPath))
+	}
+	if info.Size() != expectedBytes {
+		os.Remove(partPath)
+		removeSidecar(scPath)
+		return ferrors.NewChecksumMismatchError(fmt.Sprintf("part %v is %v bytes, expected %v", partPath, info.Size(), expectedBytes))
+	}
+
+	if expectedDigest != "" {
+		if digest := hex.EncodeToString(sw.hash.Sum(nil)); digest != expectedDigest {
+			os.Remove(partPath)
+			removeSidecar(scPath)
+			return ferrors.NewChecksumMismatchError(fmt.Sprintf("part %v digest %v does not match expected %v", partPath, digest, expectedDigest))
+		}
+	}
+
+	removeSidecar(scPath)
+
+	glog.V(2).Infof("Successfully wrote %v from %v", partPath, source.URL)
+	return nil
+}
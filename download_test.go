@@ -0,0 +1,275 @@
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ferrors "github.com/open-horizon/horizon-pkg-fetch/errors"
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+)
+
+// partServer serves a single Pkg part's bytes the way httpTransport expects:
+// HEAD for Stat (size + ETag), GET honoring a Range header for Fetch unless
+// honorRange is false, in which case every GET returns the whole object with
+// a 200 regardless of Range -- simulating a source that ignores byte ranges.
+type partServer struct {
+	content    []byte
+	etag       string
+	honorRange bool
+	rangesSeen []string
+}
+
+func newPartServer(content []byte, etag string, honorRange bool) (*httptest.Server, *partServer) {
+	ps := &partServer{content: content, etag: etag, honorRange: honorRange}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", ps.etag)
+
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", fmt.Sprintf("%v", len(ps.content)))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		rng := r.Header.Get("Range")
+		ps.rangesSeen = append(ps.rangesSeen, rng)
+
+		if rng == "" || !ps.honorRange {
+			w.WriteHeader(http.StatusOK)
+			w.Write(ps.content)
+			return
+		}
+
+		var offset int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-", &offset); err != nil || offset > len(ps.content) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(ps.content[offset:])
+	}))
+
+	return srv, ps
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeResumeState plants an in-progress download on disk: the first
+// len(prefix) bytes of the part plus a sidecar recording how much was
+// written and the hash state, as a real download would leave behind if
+// interrupted.
+func writeResumeState(t *testing.T, partPath string, prefix []byte, validator string) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(partPath, prefix, 0600); err != nil {
+		t.Fatalf("writing partial part: %v", err)
+	}
+
+	h := sha256.New()
+	h.Write(prefix)
+	state, err := marshalHash(h)
+	if err != nil {
+		t.Fatalf("marshaling hash state: %v", err)
+	}
+
+	if err := saveSidecar(sidecarPath(partPath), &progressSidecar{
+		Validator:    validator,
+		BytesWritten: int64(len(prefix)),
+		SHA256State:  state,
+	}); err != nil {
+		t.Fatalf("saving sidecar: %v", err)
+	}
+}
+
+func TestFetchPartFromSourceResumesWhenValidatorMatches(t *testing.T) {
+	content := []byte(fmt.Sprintf("%01000d", 0))
+	srv, ps := newPartServer(content, "v1", true)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	partPath := filepath.Join(dir, "part")
+	writeResumeState(t, partPath, content[:400], "v1")
+
+	transport := &httpTransport{client: srv.Client()}
+	source := horizonpkg.PartSource{URL: srv.URL}
+
+	err := fetchPartFromSource(context.Background(), transport, "part1", partPath, int64(len(content)), digestOf(content), source, 0, nil)
+	if err != nil {
+		t.Fatalf("fetchPartFromSource: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(partPath)
+	if err != nil {
+		t.Fatalf("reading resulting part: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Fatal("resumed download did not produce the expected content")
+	}
+
+	if len(ps.rangesSeen) != 1 || ps.rangesSeen[0] != "bytes=400-" {
+		t.Fatalf("expected a single request for bytes=400-, got %v", ps.rangesSeen)
+	}
+
+	if _, err := os.Stat(sidecarPath(partPath)); !os.IsNotExist(err) {
+		t.Fatalf("expected sidecar to be removed after a successful download, stat err: %v", err)
+	}
+}
+
+func TestFetchPartFromSourceRedownloadsWhenValidatorDiffers(t *testing.T) {
+	content := []byte(fmt.Sprintf("%01000d", 0))
+	srv, ps := newPartServer(content, "v2", true)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	partPath := filepath.Join(dir, "part")
+	writeResumeState(t, partPath, content[:400], "v1")
+
+	transport := &httpTransport{client: srv.Client()}
+	source := horizonpkg.PartSource{URL: srv.URL}
+
+	err := fetchPartFromSource(context.Background(), transport, "part1", partPath, int64(len(content)), digestOf(content), source, 0, nil)
+	if err != nil {
+		t.Fatalf("fetchPartFromSource: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(partPath)
+	if err != nil {
+		t.Fatalf("reading resulting part: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Fatal("redownload did not produce the expected content")
+	}
+
+	if len(ps.rangesSeen) != 1 || ps.rangesSeen[0] != "" {
+		t.Fatalf("expected a single full request (no Range) once the validator changed, got %v", ps.rangesSeen)
+	}
+}
+
+func TestFetchPartFromSourceRedownloadsWhenSidecarMissing(t *testing.T) {
+	content := []byte(fmt.Sprintf("%01000d", 0))
+	srv, ps := newPartServer(content, "v1", true)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	partPath := filepath.Join(dir, "part")
+	if err := ioutil.WriteFile(partPath, content[:400], 0600); err != nil {
+		t.Fatalf("writing partial part: %v", err)
+	}
+	// deliberately no sidecar written alongside it
+
+	transport := &httpTransport{client: srv.Client()}
+	source := horizonpkg.PartSource{URL: srv.URL}
+
+	err := fetchPartFromSource(context.Background(), transport, "part1", partPath, int64(len(content)), digestOf(content), source, 0, nil)
+	if err != nil {
+		t.Fatalf("fetchPartFromSource: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(partPath)
+	if err != nil {
+		t.Fatalf("reading resulting part: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Fatal("redownload did not produce the expected content")
+	}
+
+	if len(ps.rangesSeen) != 1 || ps.rangesSeen[0] != "" {
+		t.Fatalf("expected a single full request (no Range) with no sidecar to resume from, got %v", ps.rangesSeen)
+	}
+}
+
+func TestFetchPartFromSourceRestartsWhenRangeNotHonored(t *testing.T) {
+	content := []byte(fmt.Sprintf("%01000d", 0))
+	srv, ps := newPartServer(content, "v1", false)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	partPath := filepath.Join(dir, "part")
+	writeResumeState(t, partPath, content[:400], "v1")
+
+	transport := &httpTransport{client: srv.Client()}
+	source := horizonpkg.PartSource{URL: srv.URL}
+
+	err := fetchPartFromSource(context.Background(), transport, "part1", partPath, int64(len(content)), digestOf(content), source, 0, nil)
+	if err != nil {
+		t.Fatalf("fetchPartFromSource: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(partPath)
+	if err != nil {
+		t.Fatalf("reading resulting part: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Fatal("restarted download did not produce the expected content")
+	}
+
+	if len(ps.rangesSeen) != 2 || ps.rangesSeen[0] != "bytes=400-" || ps.rangesSeen[1] != "" {
+		t.Fatalf("expected a ranged request followed by a full restart, got %v", ps.rangesSeen)
+	}
+}
+
+func TestFetchPartFromSourceDeletesPartOnSizeMismatch(t *testing.T) {
+	content := []byte("the actual content")
+	srv, _ := newPartServer(content, "v1", true)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	partPath := filepath.Join(dir, "part")
+
+	transport := &httpTransport{client: srv.Client()}
+	source := horizonpkg.PartSource{URL: srv.URL}
+
+	err := fetchPartFromSource(context.Background(), transport, "part1", partPath, int64(len(content)+1), digestOf(content), source, 0, nil)
+	if err == nil {
+		t.Fatal("expected an error for a size mismatch, got nil")
+	}
+	if !ferrors.IsChecksumMismatch(err) {
+		t.Fatalf("expected a ChecksumMismatchError, got %T: %v", err, err)
+	}
+
+	if _, statErr := os.Stat(partPath); !os.IsNotExist(statErr) {
+		t.Fatalf("expected part to be deleted after a size mismatch, stat err: %v", statErr)
+	}
+	if _, statErr := os.Stat(sidecarPath(partPath)); !os.IsNotExist(statErr) {
+		t.Fatalf("expected sidecar to be deleted after a size mismatch, stat err: %v", statErr)
+	}
+}
+
+func TestFetchPartFromSourceDeletesPartOnDigestMismatch(t *testing.T) {
+	content := []byte("the actual content")
+	srv, _ := newPartServer(content, "v1", true)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	partPath := filepath.Join(dir, "part")
+
+	transport := &httpTransport{client: srv.Client()}
+	source := horizonpkg.PartSource{URL: srv.URL}
+
+	err := fetchPartFromSource(context.Background(), transport, "part1", partPath, int64(len(content)), "not-the-real-digest", source, 0, nil)
+	if err == nil {
+		t.Fatal("expected an error for a digest mismatch, got nil")
+	}
+	if !ferrors.IsChecksumMismatch(err) {
+		t.Fatalf("expected a ChecksumMismatchError, got %T: %v", err, err)
+	}
+
+	if _, statErr := os.Stat(partPath); !os.IsNotExist(statErr) {
+		t.Fatalf("expected part to be deleted after a digest mismatch, stat err: %v", statErr)
+	}
+	if _, statErr := os.Stat(sidecarPath(partPath)); !os.IsNotExist(statErr) {
+		t.Fatalf("expected sidecar to be deleted after a digest mismatch, stat err: %v", statErr)
+	}
+}
@@ -0,0 +1,207 @@
+// Package errors provides a small, wrappable error taxonomy for the fetch
+// package, modeled on git-lfs's approach: a wrappedError base that carries a
+// cause and context, plus predicate-style type tests so callers can decide
+// how to react to a failure (retry the whole operation, re-fetch only the
+// failed parts, or abort) without string-matching error messages.
+package errors
+
+import (
+	stderrors "errors"
+	"fmt"
+)
+
+// wrappedError is the base of every error type in this package: it carries
+// a cause and a message describing the context in which it occurred, and
+// implements Unwrap so errors.Is/errors.As see through the whole chain.
+type wrappedError struct {
+	cause   error
+	message string
+}
+
+func (e *wrappedError) Error() string {
+	if e.cause == nil {
+		return e.message
+	}
+	if e.message == "" {
+		return e.cause.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.message, e.cause.Error())
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.cause
+}
+
+// Wrap annotates err with msg, preserving err as the Unwrap cause. Wrap
+// returns nil if err is nil, so it's safe to use in `return Wrap(err, ...)`.
+func Wrap(err error, msg string) error {
+	if err == nil {
+		return nil
+	}
+	return &wrappedError{cause: err, message: msg}
+}
+
+// Wrapf is like Wrap but formats the message.
+func Wrapf(err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &wrappedError{cause: err, message: fmt.Sprintf(format, args...)}
+}
+
+// retriabler is implemented by error types that know whether retrying the
+// operation that produced them might succeed.
+type retriabler interface {
+	Retriable() bool
+}
+
+// IsRetriable walks err's Unwrap chain looking for a type that knows whether
+// it's worth retrying. Plain errors (or chains with no such type) are
+// treated as not retriable, since an unrecognized error is the conservative
+// case to stop and let a caller look at it.
+func IsRetriable(err error) bool {
+	for err != nil {
+		if r, ok := err.(retriabler); ok {
+			return r.Retriable()
+		}
+		err = stderrors.Unwrap(err)
+	}
+	return false
+}
+
+// NetworkError indicates a transient problem talking to a source (a failed
+// connection, timeout, or unexpected HTTP status). These are ordinarily
+// worth retrying.
+type NetworkError struct{ *wrappedError }
+
+func (*NetworkError) Retriable() bool { return true }
+
+// NewNetworkError wraps cause as a NetworkError with context msg.
+func NewNetworkError(cause error, msg string) error {
+	return &NetworkError{&wrappedError{cause: cause, message: msg}}
+}
+
+// IsNetworkError reports whether err is (or wraps) a NetworkError.
+func IsNetworkError(err error) bool {
+	var e *NetworkError
+	return stderrors.As(err, &e)
+}
+
+// ChecksumMismatchError indicates the bytes downloaded for a part don't
+// match the digest recorded in the Pkg's metadata. Since this can result
+// from a corrupted transfer, it's worth retrying against the same or
+// another source.
+type ChecksumMismatchError struct{ *wrappedError }
+
+func (*ChecksumMismatchError) Retriable() bool { return true }
+
+// NewChecksumMismatchError builds a ChecksumMismatchError with message msg.
+func NewChecksumMismatchError(msg string) error {
+	return &ChecksumMismatchError{&wrappedError{message: msg}}
+}
+
+// IsChecksumMismatch reports whether err is (or wraps) a ChecksumMismatchError.
+func IsChecksumMismatch(err error) bool {
+	var e *ChecksumMismatchError
+	return stderrors.As(err, &e)
+}
+
+// SourceExhaustedError indicates every source offered for a part failed.
+// Retrying immediately with the same source list is unlikely to help.
+type SourceExhaustedError struct{ *wrappedError }
+
+func (*SourceExhaustedError) Retriable() bool { return false }
+
+// NewSourceExhaustedError wraps the last per-source failure as cause.
+func NewSourceExhaustedError(cause error, msg string) error {
+	return &SourceExhaustedError{&wrappedError{cause: cause, message: msg}}
+}
+
+// IsSourceExhausted reports whether err is (or wraps) a SourceExhaustedError.
+func IsSourceExhausted(err error) bool {
+	var e *SourceExhaustedError
+	return stderrors.As(err, &e)
+}
+
+// MetaMalformedError indicates the Pkg meta document itself (not a part) is
+// missing required information or isn't valid JSON. Retrying without
+// correcting the meta document won't help.
+type MetaMalformedError struct{ *wrappedError }
+
+func (*MetaMalformedError) Retriable() bool { return false }
+
+// NewMetaMalformedError wraps cause (which may be nil) as a MetaMalformedError.
+func NewMetaMalformedError(cause error, msg string) error {
+	return &MetaMalformedError{&wrappedError{cause: cause, message: msg}}
+}
+
+// IsMetaMalformed reports whether err is (or wraps) a MetaMalformedError.
+func IsMetaMalformed(err error) bool {
+	var e *MetaMalformedError
+	return stderrors.As(err, &e)
+}
+
+// DiskError indicates a local filesystem operation (open, stat, remove,
+// mkdir, ...) failed. Retrying the same operation against the same disk
+// rarely helps.
+type DiskError struct{ *wrappedError }
+
+func (*DiskError) Retriable() bool { return false }
+
+// NewDiskError wraps cause as a DiskError with context msg.
+func NewDiskError(cause error, msg string) error {
+	return &DiskError{&wrappedError{cause: cause, message: msg}}
+}
+
+// IsDiskError reports whether err is (or wraps) a DiskError.
+func IsDiskError(err error) bool {
+	var e *DiskError
+	return stderrors.As(err, &e)
+}
+
+// VerificationErrorKind distinguishes the ways Pkg part signature-chain
+// verification can fail, so callers can tell an untrusted or expired signer
+// from a tampered part.
+type VerificationErrorKind int
+
+const (
+	// UnknownRootKey means a signing-key cert (or the trust store itself) could not be verified against any trusted root key.
+	UnknownRootKey VerificationErrorKind = iota
+	// ExpiredSigningKey means a signing-key cert's not-after timestamp has passed.
+	ExpiredSigningKey
+	// BadSignature means a detached signature did not verify, or too few valid signatures were found to meet the threshold.
+	BadSignature
+	// DigestMismatch means the part's on-disk SHA-256 digest could not be computed.
+	DigestMismatch
+)
+
+// VerificationError indicates a Pkg part failed the distsign-style
+// signature-chain check. It is not retriable: verifyPkgPart has already
+// deleted the part from disk (except when the signature threshold it was
+// given is below 1, which leaves the part in place), and retrying against an
+// untrusted or expired signer will only fail again.
+type VerificationError struct {
+	*wrappedError
+	Kind VerificationErrorKind
+}
+
+// NewVerificationError builds a VerificationError of the given kind.
+func NewVerificationError(kind VerificationErrorKind, cause error, msg string) error {
+	return &VerificationError{wrappedError: &wrappedError{cause: cause, message: msg}, Kind: kind}
+}
+
+// IsVerificationError reports whether err is (or wraps) a VerificationError.
+func IsVerificationError(err error) bool {
+	var e *VerificationError
+	return stderrors.As(err, &e)
+}
+
+// VerificationErrorKindOf returns the VerificationErrorKind of err, if err
+// is (or wraps) a VerificationError.
+func VerificationErrorKindOf(err error) (VerificationErrorKind, bool) {
+	var e *VerificationError
+	if !stderrors.As(err, &e) {
+		return 0, false
+	}
+	return e.Kind, true
+}
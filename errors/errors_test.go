@@ -0,0 +1,108 @@
+package errors
+
+import (
+	stderrors "errors"
+	"testing"
+)
+
+func TestWrapNilIsNil(t *testing.T) {
+	if err := Wrap(nil, "context"); err != nil {
+		t.Fatalf("expected Wrap(nil, ...) to return nil, got %v", err)
+	}
+	if err := Wrapf(nil, "context %v", 1); err != nil {
+		t.Fatalf("expected Wrapf(nil, ...) to return nil, got %v", err)
+	}
+}
+
+func TestWrapPreservesCauseForUnwrap(t *testing.T) {
+	cause := stderrors.New("underlying failure")
+	wrapped := Wrap(cause, "doing a thing")
+
+	if !stderrors.Is(wrapped, cause) {
+		t.Fatalf("expected errors.Is to see through Wrap to the cause")
+	}
+	if got := wrapped.Error(); got != "doing a thing: underlying failure" {
+		t.Fatalf("unexpected Error() string: %v", got)
+	}
+}
+
+func TestWrapWithoutMessageUsesCauseString(t *testing.T) {
+	cause := stderrors.New("underlying failure")
+	wrapped := &wrappedError{cause: cause}
+
+	if got := wrapped.Error(); got != "underlying failure" {
+		t.Fatalf("unexpected Error() string: %v", got)
+	}
+}
+
+func TestIsRetriableByType(t *testing.T) {
+	cases := []struct {
+		name      string
+		err       error
+		retriable bool
+	}{
+		{"network", NewNetworkError(stderrors.New("timeout"), "fetching"), true},
+		{"checksum mismatch", NewChecksumMismatchError("bad digest"), true},
+		{"source exhausted", NewSourceExhaustedError(stderrors.New("timeout"), "all sources failed"), false},
+		{"meta malformed", NewMetaMalformedError(stderrors.New("bad json"), "parsing"), false},
+		{"disk", NewDiskError(stderrors.New("enoent"), "removing"), false},
+		{"verification", NewVerificationError(BadSignature, nil, "bad sig"), false},
+		{"plain error", stderrors.New("unrecognized"), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := IsRetriable(c.err); got != c.retriable {
+				t.Fatalf("IsRetriable(%v) = %v, want %v", c.err, got, c.retriable)
+			}
+		})
+	}
+}
+
+func TestIsRetriableSeesThroughWrap(t *testing.T) {
+	err := Wrap(NewNetworkError(nil, "probing"), "retrying")
+	if !IsRetriable(err) {
+		t.Fatal("expected IsRetriable to walk the Unwrap chain to the NetworkError")
+	}
+}
+
+func TestTypePredicates(t *testing.T) {
+	if !IsNetworkError(NewNetworkError(nil, "x")) {
+		t.Error("IsNetworkError false negative")
+	}
+	if !IsChecksumMismatch(NewChecksumMismatchError("x")) {
+		t.Error("IsChecksumMismatch false negative")
+	}
+	if !IsSourceExhausted(NewSourceExhaustedError(nil, "x")) {
+		t.Error("IsSourceExhausted false negative")
+	}
+	if !IsMetaMalformed(NewMetaMalformedError(nil, "x")) {
+		t.Error("IsMetaMalformed false negative")
+	}
+	if !IsDiskError(NewDiskError(nil, "x")) {
+		t.Error("IsDiskError false negative")
+	}
+	if !IsVerificationError(NewVerificationError(BadSignature, nil, "x")) {
+		t.Error("IsVerificationError false negative")
+	}
+
+	if IsNetworkError(NewDiskError(nil, "x")) {
+		t.Error("IsNetworkError false positive")
+	}
+}
+
+func TestVerificationErrorKindOf(t *testing.T) {
+	err := NewVerificationError(ExpiredSigningKey, nil, "expired")
+
+	kind, ok := VerificationErrorKindOf(err)
+	if !ok {
+		t.Fatal("expected VerificationErrorKindOf to find a VerificationError")
+	}
+	if kind != ExpiredSigningKey {
+		t.Fatalf("VerificationErrorKindOf = %v, want %v", kind, ExpiredSigningKey)
+	}
+
+	if _, ok := VerificationErrorKindOf(stderrors.New("plain")); ok {
+		t.Fatal("expected VerificationErrorKindOf to report false for a non-VerificationError")
+	}
+}
@@ -1,25 +1,50 @@
 package fetch
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/golang/glog"
+	ferrors "github.com/open-horizon/horizon-pkg-fetch/errors"
 	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+)
+
+// Options tunes how PkgFetch downloads and verifies Pkg parts. The zero
+// value is valid; unset fields fall back to the defaults below.
+type Options struct {
+	// MaxConcurrentParts bounds how many parts are fetched at once.
+	MaxConcurrentParts int
+	// MaxRetriesPerSource bounds how many times a single source is retried before moving on to the next source.
+	MaxRetriesPerSource int
+	// BackoffBase is the base of the exponential backoff (with jitter) applied between retries of the same source.
+	BackoffBase time.Duration
+	// Context, if set, cancels in-flight fetches; a canceled fetch returns context.Canceled distinctly from network errors.
+	Context context.Context
+	// Progress, if set, is invoked from a single serialized goroutine with incremental download/verify progress.
+	Progress func(ProgressEvent)
+}
+
+const (
+	defaultMaxConcurrentParts  = 4
+	defaultMaxRetriesPerSource = 2
+	defaultBackoffBase         = 500 * time.Millisecond
 )
 
 func writeFile(destinationDir string, fileName string, content []byte) (string, error) {
 	destFilePath := path.Join(destinationDir, fileName)
 	// this'll overwrite
 	if err := ioutil.WriteFile(destFilePath, content, 0600); err != nil {
-		return "", err
+		return "", ferrors.NewDiskError(err, fmt.Sprintf("writing %v", destFilePath))
 	}
 
 	return destFilePath, nil
@@ -33,18 +58,21 @@ func fetchPkgMeta(client *http.Client, pkgURL string, destinationDir string) (*h
 	// fetch, hydrate
 	response, err := client.Get(pkgURL)
 	if err != nil {
-		return nil, err
+		return nil, ferrors.NewNetworkError(err, fmt.Sprintf("fetching pkg meta from %v", pkgURL))
 	}
 
 	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Unexpected status code in response to Horizon Pkg fetch: %v", response.StatusCode)
+		return nil, ferrors.NewNetworkError(nil, fmt.Sprintf("unexpected status code %v fetching pkg meta from %v", response.StatusCode, pkgURL))
 	}
 	defer response.Body.Close()
 	rawBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, ferrors.NewNetworkError(err, fmt.Sprintf("reading pkg meta body from %v", pkgURL))
+	}
 
 	var pkg horizonpkg.Pkg
 	if err := json.Unmarshal(rawBody, &pkg); err != nil {
-		return nil, err
+		return nil, ferrors.NewMetaMalformedError(err, fmt.Sprintf("parsing pkg meta from %v", pkgURL))
 	}
 
 	fetchFilePath, err := writeFile(destinationDir, fmt.Sprintf("%v.json", pkg.ID), rawBody)
@@ -63,7 +91,7 @@ func precheckPkgParts(pkg *horizonpkg.Pkg) error {
 	for _, part := range pkg.Parts {
 		repoTag, exists := pkg.Meta.Provides.Images[part.ID]
 		if !exists {
-			return fmt.Errorf("Error in pkg file: Meta.Provides is expected to contain metadata about each part and it is missing info about part %v", part)
+			return ferrors.NewMetaMalformedError(nil, fmt.Sprintf("Meta.Provides is expected to contain metadata about each part and it is missing info about part %v", part))
 		}
 		glog.V(2).Infof("Precheck of container part info %v (part id: %v) passed, will fetch", repoTag, part.ID)
 
@@ -72,16 +100,10 @@ func precheckPkgParts(pkg *horizonpkg.Pkg) error {
 	return nil
 }
 
-// VerificationError extends error, indicating a problem verifying a Pkg part
-type VerificationError struct {
-	msg string
-}
-
-// Error returns the error message in this error
-func (e VerificationError) Error() string {
-	return e.msg
-}
-
+// fetchErrRecorder aggregates the per-part errors from a fetchAndVerify run
+// so the caller of PkgFetch can decide what to do next: Retriable reports
+// whether retrying the whole operation outright might help, while
+// FailedParts lets a caller re-fetch just the parts that didn't make it.
 type fetchErrRecorder struct {
 	Errors    map[string]error
 	WriteLock sync.Mutex
@@ -94,102 +116,70 @@ func newFetchErrRecorder() fetchErrRecorder {
 	}
 }
 
-func fetchPkgPart(client *http.Client, partPath string, expectedBytes int64, sources []horizonpkg.PartSource) error {
-	tryOpen := func(path string) (*os.File, error) {
-		return os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600)
-	}
-
-	tryRemove := func(f *os.File, msg string) error {
-		glog.Error(msg)
-
-		f.Close()
-		err := os.Remove(f.Name())
-		if err != nil {
-			return err
-		}
+// Error implements error, summarizing every recorded per-part failure.
+func (r *fetchErrRecorder) Error() string {
+	r.WriteLock.Lock()
+	defer r.WriteLock.Unlock()
 
-		return nil
+	msgs := make([]string, 0, len(r.Errors))
+	for id, err := range r.Errors {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", id, err))
 	}
+	sort.Strings(msgs)
 
-	var partFile *os.File
-	var openErr error
-	partFile, openErr = tryOpen(partPath)
-
-	if openErr != nil && os.IsExist(openErr) {
-
-		info, statErr := os.Stat(partPath)
-		if statErr != nil {
-			err := tryRemove(partFile, fmt.Sprintf("Error getting status for file %v although it exists. Will attempt to delete it and continue", partPath))
-			if err != nil {
-				return err
-			}
+	return fmt.Sprintf("failed to fetch %v part(s): %v", len(r.Errors), strings.Join(msgs, "; "))
+}
 
-		} else if info.Size() == expectedBytes {
-			glog.V(3).Infof("Part file %v exists on disk and it has the appropriate size, skipping redownload", partPath)
-			return nil
-		} else {
-			// TODO: can try resume here if we have an HTTP server that knows how to handle it
-			err := tryRemove(partFile, fmt.Sprintf("Part file %v exists on disk but it's not complete (%v bytes and should be %v bytes). Deleting it and trying again", partPath, info.Size(), expectedBytes))
-			if err != nil {
-				return err
-			}
-		}
-		partFile.Close()
-		partFile, openErr = tryOpen(partPath)
-		if openErr != nil {
-			return openErr
-		}
+// Retriable reports whether every recorded failure is one that retrying the
+// whole operation might resolve, as judged by ferrors.IsRetriable. A part
+// whose sources all failed (even from network hiccups) is recorded as a
+// SourceExhaustedError, which is not retriable, and so is a part that failed
+// verification; if any recorded failure is not retriable, Retriable is false.
+func (r *fetchErrRecorder) Retriable() bool {
+	r.WriteLock.Lock()
+	defer r.WriteLock.Unlock()
+
+	if len(r.Errors) == 0 {
+		return false
 	}
 
-	// we are clean, try download
-	for _, source := range sources {
-		response, err := client.Get(source.URL)
-		if err != nil || response.StatusCode != 200 {
-			glog.Errorf("Failed to download part %v from %v. Response: %v. Error: %v", partPath, source, response, err)
-		} else {
-			defer response.Body.Close()
-			bytes, err := io.Copy(partFile, response.Body)
-			if err != nil {
-				return fmt.Errorf("IO copy from HTTP response body failed on part: %v. Error: %v", partPath, err)
-			}
-
-			if bytes != expectedBytes {
-				glog.Errorf("Error in download and copy of part %v from %v", partPath, source)
-
-				// ignore error, give it another shot
-				tryRemove(partFile, fmt.Sprintf("Error in download and copy of part %v from %v", partPath, source))
-
-				partFile, openErr = tryOpen(partPath)
-				if openErr != nil {
-					return openErr
-				}
-				defer partFile.Close()
-				continue
-			} else {
-				glog.V(2).Infof("Successfully wrote %v", partPath)
-				return nil
-			}
+	for _, err := range r.Errors {
+		if !ferrors.IsRetriable(err) {
+			return false
 		}
 	}
 
-	// try fetching a part from each source, if all fail exit with error
-	return fmt.Errorf("Failed to complete download of %v", partPath)
+	return true
 }
 
-// all provided signatures must match keys in userKeysDir
-func verifyPkgPart(userKeysDir string, partPath string, signatures []string) error {
+// FailedParts returns the IDs of parts that recorded an error, so a caller
+// can re-fetch just those instead of the whole Pkg.
+func (r *fetchErrRecorder) FailedParts() []string {
+	r.WriteLock.Lock()
+	defer r.WriteLock.Unlock()
 
-	glog.V(5).Infof("Verifying pkg part %v with userKeysDir %v and signatures %v", partPath, userKeysDir, signatures)
+	parts := make([]string, 0, len(r.Errors))
+	for id := range r.Errors {
+		parts = append(parts, id)
+	}
+
+	return parts
+}
 
-	// TODO: you were here!!!
+func fetchAndVerify(httpClientFactory func(overrideTimeoutS *uint) *http.Client, parts horizonpkg.DockerImageParts, destinationDir string, userKeysDir string, signatureThreshold int, opts Options) ([]string, error) {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
-	// skip download if file name exists
+	maxConcurrent := opts.MaxConcurrentParts
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentParts
+	}
 
-	// try fetching a part from each source, if all fail *delete the bogus file* and exit with error
-	return VerificationError{fmt.Sprintf("Verification of failed of part %v", partPath)}
-}
+	sink := newProgressSink(opts.Progress)
+	defer sink.close()
 
-func fetchAndVerify(httpClientFactory func(overrideTimeoutS *uint) *http.Client, parts horizonpkg.DockerImageParts, destinationDir string, userKeysDir string) ([]string, error) {
 	fetchErrs := newFetchErrRecorder()
 	var fetched []string
 
@@ -204,46 +194,67 @@ func fetchAndVerify(httpClientFactory func(overrideTimeoutS *uint) *http.Client,
 			fetchErrs.Errors[id] = err
 		} else if partPath != "" {
 			// success
-			var abs string
-			abs, err = filepath.Abs(partPath)
-			if err != nil {
-				fetched = append(fetched, abs)
+			abs, absErr := filepath.Abs(partPath)
+			if absErr != nil {
+				fetchErrs.Errors[id] = ferrors.NewDiskError(absErr, fmt.Sprintf("resolving absolute path for %v", partPath))
+				return
 			}
-			fetchErrs.Errors[id] = err
+			fetched = append(fetched, abs)
 		}
 	}
 
+	sem := make(chan struct{}, maxConcurrent)
 	var group sync.WaitGroup
 
 	for name, part := range parts {
+		if ctx.Err() != nil {
+			break
+		}
 
 		group.Add(1)
+		sem <- struct{}{}
 
 		// wrap up the functionality per part; (note that we avoid problematic closed-over iteration vars in the go routine)
 		go func(name string, part horizonpkg.DockerImagePart) {
 			defer group.Done()
+			defer func() { <-sem }()
 
 			// we don't care about file extensions if they're not in the ID
 			partPath := path.Join(destinationDir, name)
 
 			glog.V(5).Infof("Dispatched goroutine to download (%v) to path: %v (part: %v)", name, partPath, part)
 
+			sink.emit(ProgressEvent{PartID: name, TotalBytes: part.Bytes, Phase: PhaseStarted})
+
 			glog.V(2).Infof("Fetching %v", part.ID)
-			addResult(name, fetchPkgPart(httpClientFactory(nil), partPath, part.Bytes, part.Sources), partPath)
+			if err := fetchPkgPart(ctx, httpClientFactory(nil), name, partPath, part.Bytes, part.Digest, part.Sources, opts, sink); err != nil {
+				sink.emit(ProgressEvent{PartID: name, TotalBytes: part.Bytes, Phase: PhaseFailed})
+				addResult(name, err, partPath)
+				return
+			}
+
+			sink.emit(ProgressEvent{PartID: name, BytesDownloaded: part.Bytes, TotalBytes: part.Bytes, Phase: PhaseVerifying})
 
-			// TODO: support retries here
-			if len(fetchErrs.Errors) == 0 {
-				glog.V(2).Infof("Verifying %v", part)
-				addResult(name, verifyPkgPart(userKeysDir, partPath, part.Signatures), partPath)
+			glog.V(2).Infof("Verifying %v", part)
+			if err := verifyPkgPart(userKeysDir, partPath, part.SigningCerts, part.Signatures, signatureThreshold); err != nil {
+				sink.emit(ProgressEvent{PartID: name, TotalBytes: part.Bytes, Phase: PhaseFailed})
+				addResult(name, err, partPath)
+				return
 			}
 
+			sink.emit(ProgressEvent{PartID: name, BytesDownloaded: part.Bytes, TotalBytes: part.Bytes, Phase: PhaseDone})
+			addResult(name, nil, partPath)
 		}(name, part)
 	}
 
 	group.Wait()
 
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
 	if len(fetchErrs.Errors) > 0 {
-		return nil, fmt.Errorf("Error fetching parts. Errors: %v", &fetchErrs)
+		return nil, &fetchErrs
 	}
 
 	return fetched, nil
@@ -251,7 +262,12 @@ func fetchAndVerify(httpClientFactory func(overrideTimeoutS *uint) *http.Client,
 
 // PkgFetch ...
 //     pkgURL is the URL of the pkg file containing the image content
-func PkgFetch(httpClientFactory func(overrideTimeoutS *uint) *http.Client, pkgURL *url.URL, destinationDir string, userKeysDir string) ([]string, error) {
+//     signatureThreshold is the number of distinct, certified signing keys
+//     that must have validly signed a part's digest before it is accepted
+//     (M-of-N verification)
+//     opts tunes concurrency, retries, cancellation and progress reporting;
+//     its zero value is valid
+func PkgFetch(httpClientFactory func(overrideTimeoutS *uint) *http.Client, pkgURL *url.URL, destinationDir string, userKeysDir string, signatureThreshold int, opts Options) ([]string, error) {
 	client := httpClientFactory(nil)
 
 	pkg, err := fetchPkgMeta(client, pkgURL.String(), destinationDir)
@@ -271,7 +287,7 @@ func PkgFetch(httpClientFactory func(overrideTimeoutS *uint) *http.Client, pkgUR
 	}
 
 	var fetched []string
-	fetched, err = fetchAndVerify(httpClientFactory, pkg.Parts, destinationDir, userKeysDir)
+	fetched, err = fetchAndVerify(httpClientFactory, pkg.Parts, destinationDir, userKeysDir, signatureThreshold, opts)
 	if err != nil {
 		return nil, err
 	}
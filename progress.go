@@ -0,0 +1,144 @@
+package fetch
+
+import (
+	"io"
+	"time"
+)
+
+// Phase marks where in a single part's lifecycle a ProgressEvent was
+// emitted.
+type Phase int
+
+const (
+	PhaseStarted Phase = iota
+	PhaseDownloading
+	PhaseVerifying
+	PhaseDone
+	PhaseFailed
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseStarted:
+		return "Started"
+	case PhaseDownloading:
+		return "Downloading"
+	case PhaseVerifying:
+		return "Verifying"
+	case PhaseDone:
+		return "Done"
+	case PhaseFailed:
+		return "Failed"
+	default:
+		return "Unknown"
+	}
+}
+
+// ProgressEvent reports incremental progress on a single Pkg part.
+type ProgressEvent struct {
+	PartID          string
+	BytesDownloaded int64
+	TotalBytes      int64
+	SourceURL       string
+	Attempt         int
+	Phase           Phase
+}
+
+// progressReportInterval and progressReportBytes bound how often a
+// progressCountingWriter emits a Downloading event: whichever comes first.
+const (
+	progressReportInterval = 500 * time.Millisecond
+	progressReportBytes    = 256 * 1024
+)
+
+// progressSink serializes ProgressEvents from many concurrent download
+// workers onto a single goroutine, so an Options.Progress callback never
+// has to worry about being called concurrently.
+type progressSink struct {
+	events chan ProgressEvent
+	done   chan struct{}
+}
+
+func newProgressSink(cb func(ProgressEvent)) *progressSink {
+	s := &progressSink{
+		events: make(chan ProgressEvent, 64),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.done)
+		for ev := range s.events {
+			if cb != nil {
+				cb(ev)
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *progressSink) emit(ev ProgressEvent) {
+	if s == nil {
+		return
+	}
+	s.events <- ev
+}
+
+func (s *progressSink) close() {
+	if s == nil {
+		return
+	}
+	close(s.events)
+	<-s.done
+}
+
+// progressCountingWriter decorates a part download's destination writer,
+// emitting periodic Downloading ProgressEvents as bytes land.
+type progressCountingWriter struct {
+	io.Writer
+	sink       *progressSink
+	partID     string
+	sourceURL  string
+	attempt    int
+	total      int64
+	written    int64
+	lastReport int64
+	lastEmit   time.Time
+}
+
+func newProgressCountingWriter(w io.Writer, sink *progressSink, partID, sourceURL string, attempt int, total, alreadyWritten int64) *progressCountingWriter {
+	return &progressCountingWriter{
+		Writer:    w,
+		sink:      sink,
+		partID:    partID,
+		sourceURL: sourceURL,
+		attempt:   attempt,
+		total:     total,
+		written:   alreadyWritten,
+		lastEmit:  time.Now(),
+	}
+}
+
+func (w *progressCountingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.written += int64(n)
+
+	if w.written-w.lastReport >= progressReportBytes || time.Since(w.lastEmit) >= progressReportInterval {
+		w.report()
+	}
+
+	return n, err
+}
+
+func (w *progressCountingWriter) report() {
+	w.lastReport = w.written
+	w.lastEmit = time.Now()
+	w.sink.emit(ProgressEvent{
+		PartID:          w.partID,
+		BytesDownloaded: w.written,
+		TotalBytes:      w.total,
+		SourceURL:       w.sourceURL,
+		Attempt:         w.attempt,
+		Phase:           PhaseDownloading,
+	})
+}
@@ -0,0 +1,81 @@
+package fetch
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBackoffWithJitterGrowsExponentially checks that the non-jitter floor of
+// backoffWithJitter doubles per attempt and that its jitter stays within one
+// base's worth, so retries of a flaky source spread out instead of
+// thundering in lockstep.
+func TestBackoffWithJitterGrowsExponentially(t *testing.T) {
+	base := 100 * time.Millisecond
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		floor := base << uint(attempt-1)
+		ceil := floor + base
+
+		for i := 0; i < 20; i++ {
+			d := backoffWithJitter(base, attempt)
+			if d < floor || d > ceil {
+				t.Fatalf("attempt %v: backoffWithJitter = %v, want in [%v, %v]", attempt, d, floor, ceil)
+			}
+		}
+	}
+}
+
+func TestProgressCountingWriterEmitsOnByteThreshold(t *testing.T) {
+	var events []ProgressEvent
+	sink := newProgressSink(func(ev ProgressEvent) {
+		events = append(events, ev)
+	})
+
+	w := newProgressCountingWriter(&discardWriter{}, sink, "part1", "http://example.com/part1", 0, 1<<20, 0)
+
+	chunk := make([]byte, progressReportBytes)
+	if _, err := w.Write(chunk); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	sink.close()
+
+	if len(events) == 0 {
+		t.Fatal("expected at least one ProgressEvent once the byte threshold was crossed")
+	}
+	last := events[len(events)-1]
+	if last.Phase != PhaseDownloading {
+		t.Fatalf("event Phase = %v, want PhaseDownloading", last.Phase)
+	}
+	if last.BytesDownloaded != progressReportBytes {
+		t.Fatalf("event BytesDownloaded = %v, want %v", last.BytesDownloaded, progressReportBytes)
+	}
+}
+
+func TestProgressCountingWriterDoesNotEmitBelowThreshold(t *testing.T) {
+	var events []ProgressEvent
+	sink := newProgressSink(func(ev ProgressEvent) {
+		events = append(events, ev)
+	})
+
+	w := newProgressCountingWriter(&discardWriter{}, sink, "part1", "http://example.com/part1", 0, 1<<20, 0)
+	// stay well under progressReportBytes and well under progressReportInterval
+	if _, err := w.Write(make([]byte, 16)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	sink.close()
+
+	if len(events) != 0 {
+		t.Fatalf("expected no ProgressEvent below the byte/time thresholds, got %v", len(events))
+	}
+}
+
+// discardWriter is an io.Writer that reports every byte written without
+// retaining it, so progressCountingWriter tests don't need a real download
+// destination.
+type discardWriter struct{}
+
+func (*discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
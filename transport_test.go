@@ -0,0 +1,157 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/open-horizon/horizon-pkg-fetch/horizonpkg"
+)
+
+func TestSplitOCIReference(t *testing.T) {
+	cases := []struct {
+		name       string
+		rawURL     string
+		wantRepo   string
+		wantDigest string
+		wantErr    bool
+	}{
+		{
+			name:       "good reference",
+			rawURL:     "oci://registry.example.com/org/repo@sha256:deadbeef",
+			wantRepo:   "org/repo",
+			wantDigest: "sha256:deadbeef",
+		},
+		{
+			name:    "missing digest",
+			rawURL:  "oci://registry.example.com/org/repo",
+			wantErr: true,
+		},
+		{
+			name:    "empty path",
+			rawURL:  "oci://registry.example.com",
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			u, err := url.Parse(c.rawURL)
+			if err != nil {
+				t.Fatalf("parsing test URL: %v", err)
+			}
+
+			repo, digest, err := splitOCIReference(u)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error for %v, got repo=%v digest=%v", c.rawURL, repo, digest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error for %v: %v", c.rawURL, err)
+			}
+			if repo != c.wantRepo || digest != c.wantDigest {
+				t.Fatalf("splitOCIReference(%v) = (%v, %v), want (%v, %v)", c.rawURL, repo, digest, c.wantRepo, c.wantDigest)
+			}
+		})
+	}
+}
+
+func TestFileTransportFetchSeeksToOffset(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "part")
+	content := []byte("0123456789")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("writing test file: %v", err)
+	}
+
+	src := horizonpkg.PartSource{URL: "file://" + path}
+	ft := &fileTransport{}
+
+	var buf bytes.Buffer
+	n, err := ft.Fetch(context.Background(), src, &buf, 4)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if want := int64(len(content) - 4); n != want {
+		t.Fatalf("Fetch returned %v bytes, want %v", n, want)
+	}
+	if got := buf.String(); got != "456789" {
+		t.Fatalf("Fetch wrote %q, want %q", got, "456789")
+	}
+}
+
+func TestFileTransportStatReportsSizeAndValidator(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "part")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0600); err != nil {
+		t.Fatalf("writing test file: %v", err)
+	}
+
+	src := horizonpkg.PartSource{URL: "file://" + path}
+	ft := &fileTransport{}
+
+	size, validator, err := ft.Stat(context.Background(), src)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if size != 5 {
+		t.Fatalf("Stat size = %v, want 5", size)
+	}
+	if validator == "" {
+		t.Fatal("expected a non-empty validator")
+	}
+
+	// modifying the file changes its validator, so a resumed fetch against a
+	// stale sidecar can detect the object moved out from under it
+	if err := os.Truncate(path, 3); err != nil {
+		t.Fatalf("truncating test file: %v", err)
+	}
+	_, validator2, err := ft.Stat(context.Background(), src)
+	if err != nil {
+		t.Fatalf("Stat after truncate: %v", err)
+	}
+	if validator2 == validator {
+		t.Fatal("expected validator to change after the file's size changed")
+	}
+}
+
+func TestTransportRegistryForSourceDispatchesByScheme(t *testing.T) {
+	r := newTransportRegistry(nil)
+
+	cases := []struct {
+		scheme  string
+		url     string
+		wantErr bool
+	}{
+		{"http", "http://example.com/part", false},
+		{"https", "https://example.com/part", false},
+		{"file", "file:///tmp/part", false},
+		{"oci", "oci://example.com/repo@sha256:abc", false},
+		{"docker", "docker://example.com/repo@sha256:abc", false},
+		{"unregistered scheme", "ftp://example.com/part", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.scheme, func(t *testing.T) {
+			transport, err := r.forSource(horizonpkg.PartSource{URL: c.url})
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error resolving %v, got transport %T", c.url, transport)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolving %v: %v", c.url, err)
+			}
+			if transport == nil {
+				t.Fatalf("expected a non-nil transport for %v", c.url)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package fetch
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	ferrors "github.com/open-horizon/horizon-pkg-fetch/errors"
+)
+
+// signingCert is a short-lived signing key certificate, distsign-style: an
+// Ed25519 signing pubkey and an expiry, signed by one of the offline root
+// keys trusted by this installation.
+type signingCert struct {
+	SigningKey ed25519.PublicKey `json:"signing_key"`
+	NotAfter   time.Time         `json:"not_after"`
+	Signature  []byte            `json:"signature"`
+}
+
+// signable returns the bytes a root key signs over to certify this cert.
+func (c signingCert) signable() []byte {
+	return append(append([]byte{}, c.SigningKey...), []byte(c.NotAfter.UTC().Format(time.RFC3339))...)
+}
+
+// signedDigest is a detached signature of a part's SHA-256 digest by one of
+// the signing keys certified in a signingCert.
+type signedDigest struct {
+	SigningKey ed25519.PublicKey `json:"signing_key"`
+	Signature  []byte            `json:"signature"`
+}
+
+// loadRootKeys reads every trusted root Ed25519 public key out of
+// userKeysDir. Each file holds one raw 32-byte Ed25519 public key.
+func loadRootKeys(userKeysDir string) ([]ed25519.PublicKey, error) {
+	entries, err := ioutil.ReadDir(userKeysDir)
+	if err != nil {
+		return nil, ferrors.NewDiskError(err, fmt.Sprintf("reading userKeysDir %v", userKeysDir))
+	}
+
+	var keys []ed25519.PublicKey
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(filepath.Join(userKeysDir, entry.Name()))
+		if err != nil {
+			return nil, ferrors.NewDiskError(err, fmt.Sprintf("reading root key %v", entry.Name()))
+		}
+
+		if len(raw) != ed25519.PublicKeySize {
+			glog.Warningf("Skipping %v in userKeysDir: not a %v-byte Ed25519 public key", entry.Name(), ed25519.PublicKeySize)
+			continue
+		}
+
+		keys = append(keys, ed25519.PublicKey(raw))
+	}
+
+	if len(keys) == 0 {
+		return nil, ferrors.NewVerificationError(ferrors.UnknownRootKey, nil, fmt.Sprintf("no trusted root keys found in %v", userKeysDir))
+	}
+
+	return keys, nil
+}
+
+// sha256File streams the SHA-256 digest of the file at partPath without
+// loading it into memory.
+func sha256File(partPath string) ([]byte, error) {
+	f, err := os.Open(partPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// verifyPkgPart checks a downloaded part against a distsign-style two-tier
+// Ed25519 signature chain: certs certify short-lived signing keys against the
+// root keys trusted in userKeysDir, and signatures are detached signatures of
+// the part's SHA-256 digest by those signing keys. At least threshold
+// distinct certified signing keys must produce a valid signature over the
+// digest, or the part is rejected and deleted from disk.
+func verifyPkgPart(userKeysDir string, partPath string, certs []string, signatures []string, threshold int) error {
+	glog.V(5).Infof("Verifying pkg part %v with userKeysDir %v (%v certs, %v signatures, threshold %v)", partPath, userKeysDir, len(certs), len(signatures), threshold)
+
+	if threshold < 1 {
+		return ferrors.NewVerificationError(ferrors.BadSignature, nil, fmt.Sprintf("signatureThreshold must be at least 1, got %v", threshold))
+	}
+
+	roots, err := loadRootKeys(userKeysDir)
+	if err != nil {
+		os.Remove(partPath)
+		return err
+	}
+
+	// An individual bad cert or signature only costs that one signing key its
+	// vote toward the threshold -- it must not abort the whole check, or a
+	// single expired cert left over from routine key rotation (or a single
+	// forged signature appended to the list) would reject a part that's
+	// otherwise validly signed by enough keys to meet the threshold. Only
+	// the aggregate vote against threshold, below, fails (and deletes) the
+	// part.
+	// certsExpired, certsUntrusted and certsMalformed count why certs were
+	// rejected, so a threshold-not-met
+	// failure below can report the dominant reason (e.g. "rotate your signing
+	// keys" vs. "this part may be tampered with") instead of a single
+	// catch-all kind.
+	var certsExpired, certsUntrusted, certsMalformed int
+
+	trustedSigners := make(map[string]bool)
+	now := time.Now()
+	for _, raw := range certs {
+		var cert signingCert
+		if err := json.Unmarshal([]byte(raw), &cert); err != nil {
+			glog.Warningf("Ignoring malformed signing key cert for %v: %v", partPath, err)
+			certsMalformed++
+			continue
+		}
+
+		var signedByRoot bool
+		for _, root := range roots {
+			if ed25519.Verify(root, cert.signable(), cert.Signature) {
+				signedByRoot = true
+				break
+			}
+		}
+		if !signedByRoot {
+			glog.Warningf("Ignoring signing key cert for %v: not signed by any trusted root key", partPath)
+			certsUntrusted++
+			continue
+		}
+
+		if now.After(cert.NotAfter) {
+			glog.Warningf("Ignoring signing key cert for %v: expired at %v", partPath, cert.NotAfter)
+			certsExpired++
+			continue
+		}
+
+		trustedSigners[string(cert.SigningKey)] = true
+	}
+
+	digest, err := sha256File(partPath)
+	if err != nil {
+		os.Remove(partPath)
+		return ferrors.NewVerificationError(ferrors.DigestMismatch, err, fmt.Sprintf("hashing %v", partPath))
+	}
+
+	validSigners := make(map[string]bool)
+	for _, raw := range signatures {
+		var sig signedDigest
+		if err := json.Unmarshal([]byte(raw), &sig); err != nil {
+			glog.Warningf("Ignoring malformed signature for %v: %v", partPath, err)
+			continue
+		}
+
+		if !trustedSigners[string(sig.SigningKey)] {
+			// not certified by any cert we trusted above; ignore rather than fail outright
+			continue
+		}
+
+		if !ed25519.Verify(sig.SigningKey, digest, sig.Signature) {
+			glog.Warningf("Ignoring bad signature for %v", partPath)
+			continue
+		}
+
+		validSigners[string(sig.SigningKey)] = true
+	}
+
+	if len(validSigners) < threshold {
+		os.Remove(partPath)
+		kind := ferrors.BadSignature
+		switch {
+		case len(trustedSigners) == 0 && certsExpired > 0 && certsUntrusted == 0 && certsMalformed == 0:
+			// every cert was certified by a trusted root but has simply aged
+			// out -- a rotation problem, not tampering.
+			kind = ferrors.ExpiredSigningKey
+		case len(trustedSigners) == 0 && certsUntrusted > 0 && certsExpired == 0 && certsMalformed == 0:
+			// every cert failed the root-of-trust check outright.
+			kind = ferrors.UnknownRootKey
+		}
+		return ferrors.NewVerificationError(kind, nil, fmt.Sprintf("only %v of %v required valid signatures for %v", len(validSigners), threshold, partPath))
+	}
+
+	glog.V(2).Infof("Verified %v with %v of %v required signatures", partPath, len(validSigners), threshold)
+
+	return nil
+}
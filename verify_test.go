@@ -0,0 +1,305 @@
+package fetch
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ferrors "github.com/open-horizon/horizon-pkg-fetch/errors"
+)
+
+// newTestRoot writes a freshly generated Ed25519 root public key into dir
+// and returns the matching private key for signing test certs.
+func newTestRoot(t *testing.T, dir string) ed25519.PrivateKey {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generating root key: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "root1"), pub, 0600); err != nil {
+		t.Fatalf("writing root key: %v", err)
+	}
+
+	return priv
+}
+
+// signTestCert builds a signingCert for signingPub, certified by root, and
+// returns it JSON-encoded as verifyPkgPart expects in its certs argument.
+func signTestCert(t *testing.T, root ed25519.PrivateKey, signingPub ed25519.PublicKey, notAfter time.Time) string {
+	t.Helper()
+
+	cert := signingCert{SigningKey: signingPub, NotAfter: notAfter}
+	cert.Signature = ed25519.Sign(root, cert.signable())
+
+	raw, err := json.Marshal(cert)
+	if err != nil {
+		t.Fatalf("marshaling cert: %v", err)
+	}
+
+	return string(raw)
+}
+
+// signTestDigest builds a signedDigest over digest by signingPriv, and
+// returns it JSON-encoded as verifyPkgPart expects in its signatures
+// argument.
+func signTestDigest(t *testing.T, signingPriv ed25519.PrivateKey, digest []byte) string {
+	t.Helper()
+
+	sig := signedDigest{SigningKey: signingPriv.Public().(ed25519.PublicKey), Signature: ed25519.Sign(signingPriv, digest)}
+
+	raw, err := json.Marshal(sig)
+	if err != nil {
+		t.Fatalf("marshaling signature: %v", err)
+	}
+
+	return string(raw)
+}
+
+// writeTestPart writes content to a freshly-created file under dir and
+// returns its path.
+func writeTestPart(t *testing.T, dir string, content []byte) string {
+	t.Helper()
+
+	partPath := filepath.Join(dir, "part")
+	if err := ioutil.WriteFile(partPath, content, 0600); err != nil {
+		t.Fatalf("writing test part: %v", err)
+	}
+
+	return partPath
+}
+
+func TestVerifyPkgPartRejectsZeroThreshold(t *testing.T) {
+	userKeysDir := t.TempDir()
+	newTestRoot(t, userKeysDir)
+
+	partPath := writeTestPart(t, t.TempDir(), []byte("hello"))
+
+	err := verifyPkgPart(userKeysDir, partPath, nil, nil, 0)
+	if err == nil {
+		t.Fatal("expected an error for a zero signatureThreshold, got nil")
+	}
+	if !ferrors.IsVerificationError(err) {
+		t.Fatalf("expected a VerificationError, got %T: %v", err, err)
+	}
+	if _, err := os.Stat(partPath); err != nil {
+		t.Fatalf("expected unsigned part to be left in place for a rejected threshold, got: %v", err)
+	}
+}
+
+func TestVerifyPkgPartValidSignature(t *testing.T) {
+	userKeysDir := t.TempDir()
+	root := newTestRoot(t, userKeysDir)
+
+	signingPub, signingPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generating signing key: %v", err)
+	}
+
+	partDir := t.TempDir()
+	partPath := writeTestPart(t, partDir, []byte("pkg part content"))
+	digest, err := sha256File(partPath)
+	if err != nil {
+		t.Fatalf("hashing test part: %v", err)
+	}
+
+	cert := signTestCert(t, root, signingPub, time.Now().Add(time.Hour))
+	sig := signTestDigest(t, signingPriv, digest)
+
+	if err := verifyPkgPart(userKeysDir, partPath, []string{cert}, []string{sig}, 1); err != nil {
+		t.Fatalf("expected a validly signed part to verify, got: %v", err)
+	}
+}
+
+// TestVerifyPkgPartToleratesExpiredCertAlongsideValidOne covers the ordinary
+// key-rotation case: an expired signing-key cert left over from rotation
+// must not sink a part that's also validly signed by a still-current key.
+func TestVerifyPkgPartToleratesExpiredCertAlongsideValidOne(t *testing.T) {
+	userKeysDir := t.TempDir()
+	root := newTestRoot(t, userKeysDir)
+
+	expiredPub, expiredPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generating expired signing key: %v", err)
+	}
+	currentPub, currentPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generating current signing key: %v", err)
+	}
+
+	partDir := t.TempDir()
+	partPath := writeTestPart(t, partDir, []byte("rotated pkg part"))
+	digest, err := sha256File(partPath)
+	if err != nil {
+		t.Fatalf("hashing test part: %v", err)
+	}
+
+	expiredCert := signTestCert(t, root, expiredPub, time.Now().Add(-time.Hour))
+	currentCert := signTestCert(t, root, currentPub, time.Now().Add(time.Hour))
+
+	certs := []string{expiredCert, currentCert}
+	signatures := []string{signTestDigest(t, expiredPriv, digest), signTestDigest(t, currentPriv, digest)}
+
+	if err := verifyPkgPart(userKeysDir, partPath, certs, signatures, 1); err != nil {
+		t.Fatalf("expected part signed by one current key to verify despite an expired cert, got: %v", err)
+	}
+}
+
+// TestVerifyPkgPartToleratesForgedSignatureAlongsideValidOne covers a
+// garbage/forged signature appended to an otherwise-correctly-signed part:
+// it must be ignored rather than rejecting the whole part.
+func TestVerifyPkgPartToleratesForgedSignatureAlongsideValidOne(t *testing.T) {
+	userKeysDir := t.TempDir()
+	root := newTestRoot(t, userKeysDir)
+
+	signingPub, signingPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generating signing key: %v", err)
+	}
+
+	partDir := t.TempDir()
+	partPath := writeTestPart(t, partDir, []byte("forged sig test"))
+	digest, err := sha256File(partPath)
+	if err != nil {
+		t.Fatalf("hashing test part: %v", err)
+	}
+
+	cert := signTestCert(t, root, signingPub, time.Now().Add(time.Hour))
+	validSig := signTestDigest(t, signingPriv, digest)
+
+	forgedSig := signedDigest{SigningKey: signingPub, Signature: append([]byte{}, ed25519.Sign(signingPriv, digest)...)}
+	forgedSig.Signature[0] ^= 0xFF
+	forgedRaw, err := json.Marshal(forgedSig)
+	if err != nil {
+		t.Fatalf("marshaling forged signature: %v", err)
+	}
+
+	if err := verifyPkgPart(userKeysDir, partPath, []string{cert}, []string{string(forgedRaw), validSig}, 1); err != nil {
+		t.Fatalf("expected a forged signature to be ignored rather than reject the part, got: %v", err)
+	}
+}
+
+func TestVerifyPkgPartDeletesPartWhenThresholdNotMet(t *testing.T) {
+	userKeysDir := t.TempDir()
+	newTestRoot(t, userKeysDir)
+
+	partDir := t.TempDir()
+	partPath := writeTestPart(t, partDir, []byte("unsigned"))
+
+	err := verifyPkgPart(userKeysDir, partPath, nil, nil, 1)
+	if err == nil {
+		t.Fatal("expected an error for an unsigned part, got nil")
+	}
+	if !ferrors.IsVerificationError(err) {
+		t.Fatalf("expected a VerificationError, got %T: %v", err, err)
+	}
+	if _, statErr := os.Stat(partPath); !os.IsNotExist(statErr) {
+		t.Fatalf("expected part to be deleted after failing verification, stat err: %v", statErr)
+	}
+}
+
+// TestVerifyPkgPartReportsExpiredSigningKeyWhenAllCertsExpired covers the
+// case where every offered cert is certified by a trusted root but has aged
+// out: callers should see ExpiredSigningKey (a rotation problem), not a
+// generic BadSignature.
+func TestVerifyPkgPartReportsExpiredSigningKeyWhenAllCertsExpired(t *testing.T) {
+	userKeysDir := t.TempDir()
+	root := newTestRoot(t, userKeysDir)
+
+	signingPub, signingPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generating signing key: %v", err)
+	}
+
+	partDir := t.TempDir()
+	partPath := writeTestPart(t, partDir, []byte("expired only"))
+	digest, err := sha256File(partPath)
+	if err != nil {
+		t.Fatalf("hashing test part: %v", err)
+	}
+
+	expiredCert := signTestCert(t, root, signingPub, time.Now().Add(-time.Hour))
+	sig := signTestDigest(t, signingPriv, digest)
+
+	err = verifyPkgPart(userKeysDir, partPath, []string{expiredCert}, []string{sig}, 1)
+	if err == nil {
+		t.Fatal("expected an error when every cert has expired, got nil")
+	}
+	kind, ok := ferrors.VerificationErrorKindOf(err)
+	if !ok {
+		t.Fatalf("expected a VerificationError, got %T: %v", err, err)
+	}
+	if kind != ferrors.ExpiredSigningKey {
+		t.Fatalf("VerificationErrorKindOf = %v, want ExpiredSigningKey", kind)
+	}
+}
+
+// TestVerifyPkgPartReportsUnknownRootKeyWhenAllCertsUntrusted covers the case
+// where every offered cert fails the root-of-trust check: callers should see
+// UnknownRootKey, not a generic BadSignature.
+func TestVerifyPkgPartReportsUnknownRootKeyWhenAllCertsUntrusted(t *testing.T) {
+	userKeysDir := t.TempDir()
+	newTestRoot(t, userKeysDir)
+
+	_, otherRoot, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generating untrusted root key: %v", err)
+	}
+	signingPub, signingPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generating signing key: %v", err)
+	}
+
+	partDir := t.TempDir()
+	partPath := writeTestPart(t, partDir, []byte("untrusted only"))
+	digest, err := sha256File(partPath)
+	if err != nil {
+		t.Fatalf("hashing test part: %v", err)
+	}
+
+	untrustedCert := signTestCert(t, otherRoot, signingPub, time.Now().Add(time.Hour))
+	sig := signTestDigest(t, signingPriv, digest)
+
+	err = verifyPkgPart(userKeysDir, partPath, []string{untrustedCert}, []string{sig}, 1)
+	if err == nil {
+		t.Fatal("expected an error when every cert is untrusted, got nil")
+	}
+	kind, ok := ferrors.VerificationErrorKindOf(err)
+	if !ok {
+		t.Fatalf("expected a VerificationError, got %T: %v", err, err)
+	}
+	if kind != ferrors.UnknownRootKey {
+		t.Fatalf("VerificationErrorKindOf = %v, want UnknownRootKey", kind)
+	}
+}
+
+func TestLoadRootKeysSkipsMalformedFiles(t *testing.T) {
+	userKeysDir := t.TempDir()
+	newTestRoot(t, userKeysDir)
+
+	if err := ioutil.WriteFile(filepath.Join(userKeysDir, "not-a-key"), []byte("too short"), 0600); err != nil {
+		t.Fatalf("writing malformed key file: %v", err)
+	}
+
+	keys, err := loadRootKeys(userKeysDir)
+	if err != nil {
+		t.Fatalf("expected malformed key file to be skipped, got error: %v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected exactly 1 valid root key, got %v", len(keys))
+	}
+}
+
+func TestLoadRootKeysErrorsWhenNoneFound(t *testing.T) {
+	userKeysDir := t.TempDir()
+
+	if _, err := loadRootKeys(userKeysDir); err == nil {
+		t.Fatal("expected an error when userKeysDir has no valid root keys, got nil")
+	} else if !ferrors.IsVerificationError(err) {
+		t.Fatalf("expected a VerificationError, got %T: %v", err, err)
+	}
+}